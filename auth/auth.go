@@ -0,0 +1,29 @@
+// Package auth provides pluggable backends for authorizing SSH public
+// keys and tracking per-user connection counts, so the server isn't
+// hard-wired to Redis.
+package auth
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrQuotaExceeded is returned by Acquire when a user is already at their
+// maximum number of concurrent connections.
+var ErrQuotaExceeded = errors.New("auth: user has reached its maximum connection count")
+
+// Authenticator decides whether a user may open an SSH connection and
+// keeps track of how many connections each user currently holds open.
+// Implementations must be safe for concurrent use.
+type Authenticator interface {
+	// Authorize reports whether userID is allowed to authenticate with
+	// the given SSH public key, encoded as an authorized_keys line.
+	Authorize(ctx context.Context, userID, authorizedKeyLine string) (bool, error)
+
+	// Acquire reserves a connection slot for userID. It returns
+	// ErrQuotaExceeded if the user is already at its connection limit.
+	Acquire(ctx context.Context, userID string) error
+
+	// Release frees a connection slot previously reserved by Acquire.
+	Release(userID string)
+}
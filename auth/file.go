@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// FileAuthenticator authorizes users from per-user authorized_keys files
+// laid out as <dir>/<uuid>/authorized_keys, the same shape other
+// gliderlabs/ssh based servers read from an SSH_AUTHKEYS directory. It is
+// meant for deployments that don't want to run Redis.
+type FileAuthenticator struct {
+	dir      string
+	maxConns int64
+
+	mu    sync.Mutex
+	conns map[string]int64
+}
+
+// NewFileAuthenticator returns an Authenticator that reads authorized
+// keys from dir/<uuid>/authorized_keys and enforces maxConns concurrent
+// connections per user in memory.
+func NewFileAuthenticator(dir string, maxConns int64) *FileAuthenticator {
+	return &FileAuthenticator{dir: dir, maxConns: maxConns, conns: map[string]int64{}}
+}
+
+func (a *FileAuthenticator) Authorize(ctx context.Context, userID, authorizedKeyLine string) (bool, error) {
+	if !ValidUserID(userID) {
+		return false, nil
+	}
+
+	wantKey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(authorizedKeyLine))
+	if err != nil {
+		return false, err
+	}
+
+	f, err := os.Open(filepath.Join(a.dir, userID, "authorized_keys"))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			continue
+		}
+		if string(key.Marshal()) == string(wantKey.Marshal()) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+func (a *FileAuthenticator) Acquire(ctx context.Context, userID string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conns[userID] >= a.maxConns {
+		return ErrQuotaExceeded
+	}
+	a.conns[userID]++
+	return nil
+}
+
+func (a *FileAuthenticator) Release(userID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conns[userID] > 0 {
+		a.conns[userID]--
+	}
+}
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisAuthenticator is the original authenticator backend: users and
+// their authorized keys live in the "ssh-server:users" Redis set, and
+// concurrent connection counts are tracked in the "ssh-server:connections"
+// hash.
+type RedisAuthenticator struct {
+	rdb                   *redis.Client
+	maxConns              int64
+	userConnectionCountMu sync.Mutex
+}
+
+// NewRedisAuthenticator returns an Authenticator backed by rdb, rejecting
+// a user's connection once it already holds maxConns open connections.
+func NewRedisAuthenticator(rdb *redis.Client, maxConns int64) *RedisAuthenticator {
+	rdb.Del(context.Background(), "ssh-server:connections")
+	return &RedisAuthenticator{rdb: rdb, maxConns: maxConns}
+}
+
+func (a *RedisAuthenticator) Authorize(ctx context.Context, userID, authorizedKeyLine string) (bool, error) {
+	userString := userID + "::" + authorizedKeyLine
+	res, err := a.rdb.SIsMember(ctx, "ssh-server:users", userString).Result()
+	if err != nil {
+		return false, err
+	}
+	return res, nil
+}
+
+func (a *RedisAuthenticator) Acquire(ctx context.Context, userID string) error {
+	a.userConnectionCountMu.Lock()
+	defer a.userConnectionCountMu.Unlock()
+
+	connCntStr, _ := a.rdb.HGet(ctx, "ssh-server:connections", userID).Result()
+	// It doesn't matter if we get an error (the key does not exist), if
+	// there is something more serious it will be handled in HIncrBy.
+	connCnt, err := strconv.ParseInt(connCntStr, 10, 32)
+	if err == nil && connCnt >= a.maxConns {
+		return ErrQuotaExceeded
+	}
+
+	if err := a.rdb.HIncrBy(ctx, "ssh-server:connections", userID, 1).Err(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (a *RedisAuthenticator) Release(userID string) {
+	a.rdb.HIncrBy(context.Background(), "ssh-server:connections", userID, -1)
+}
@@ -0,0 +1,14 @@
+package auth
+
+import "regexp"
+
+// uuidPattern matches a canonical 8-4-4-4-12 hex UUID, case-insensitive.
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// ValidUserID reports whether id has the shape of a UUID. User IDs double
+// as path segments (FileAuthenticator) and Redis keys, so callers must
+// validate with this before trusting one from an untrusted source such as
+// an SSH username.
+func ValidUserID(id string) bool {
+	return uuidPattern.MatchString(id)
+}
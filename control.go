@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/joho/godotenv"
+	"github.com/redis/go-redis/v9"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// controlChannel is the Redis pub/sub channel operators publish to for
+// hot-reloading the running server: "reload-hostkeys", "reload-whitelist",
+// "kick-user:<uuid>" and "set-version:<string>".
+const controlChannel = "ssh-server:control"
+
+// contextKeyConn stashes the raw net.Conn for a connection so it can be
+// tracked by user for kick-user, since gliderlabs/ssh only hands it to us
+// through ConnCallback.
+const contextKeyConn = "raw-conn"
+
+// reloadableSigner is a gossh.Signer whose underlying key can be swapped
+// atomically. hostKeyManager installs a fixed slice of these into
+// server.HostSigners once, up front, and reload only ever stores into
+// existing slots afterwards - gliderlabs/ssh reads HostSigners under its
+// own unexported mutex on every new connection, so mutating the slice
+// itself after Serve has started would race that read.
+type reloadableSigner struct {
+	v atomic.Value // holds ssh.Signer
+}
+
+func newReloadableSigner(signer ssh.Signer) *reloadableSigner {
+	s := &reloadableSigner{}
+	s.store(signer)
+	return s
+}
+
+func (s *reloadableSigner) store(signer ssh.Signer) {
+	s.v.Store(signer)
+}
+
+func (s *reloadableSigner) current() ssh.Signer {
+	return s.v.Load().(ssh.Signer)
+}
+
+func (s *reloadableSigner) PublicKey() gossh.PublicKey {
+	return s.current().PublicKey()
+}
+
+func (s *reloadableSigner) Sign(rand io.Reader, data []byte) (*gossh.Signature, error) {
+	return s.current().Sign(rand, data)
+}
+
+// hostKeyManager owns the signers installed on the live ssh.Server so
+// reload-hostkeys can hot-swap them in without racing gliderlabs/ssh's own
+// locking around HostSigners.
+type hostKeyManager struct {
+	server      *ssh.Server
+	hostKeyPath string
+	slots       []*reloadableSigner
+}
+
+func newHostKeyManager(server *ssh.Server, hostKeyPath string) *hostKeyManager {
+	return &hostKeyManager{server: server, hostKeyPath: hostKeyPath}
+}
+
+// install loads the current host keys and installs one reloadableSigner
+// slot per key as the server's HostSigners. It must be called once before
+// the server starts serving connections; reload relies on the slots it
+// creates here and never touches server.HostSigners itself again.
+func (m *hostKeyManager) install() error {
+	signers, err := m.loadSigners()
+	if err != nil {
+		return err
+	}
+	m.slots = make([]*reloadableSigner, len(signers))
+	hostSigners := make([]ssh.Signer, len(signers))
+	for i, signer := range signers {
+		m.slots[i] = newReloadableSigner(signer)
+		hostSigners[i] = m.slots[i]
+	}
+	m.server.HostSigners = hostSigners
+	return nil
+}
+
+// reload re-walks hostKeyPath and the HOST_KEY_n environment variables and
+// stores each key into its existing slot. gliderlabs/ssh has no safe way
+// to resize HostSigners once Serve is running: if reload finds fewer keys
+// than were installed at startup, the surplus slots keep serving their
+// last key; if it finds more, the extras are logged and dropped.
+func (m *hostKeyManager) reload() error {
+	signers, err := m.loadSigners()
+	if err != nil {
+		return err
+	}
+	if len(signers) > len(m.slots) {
+		logger.Warn("reload-hostkeys found more keys than were installed at startup; extras are ignored",
+			"installed", len(m.slots), "found", len(signers))
+		signers = signers[:len(m.slots)]
+	}
+	for i, signer := range signers {
+		m.slots[i].store(signer)
+	}
+	return nil
+}
+
+// loadSigners reads the current host keys from hostKeyPath and the
+// HOST_KEY_n environment variables, in the same order install and reload
+// have always used.
+func (m *hostKeyManager) loadSigners() ([]ssh.Signer, error) {
+	hostKeyFiles, err := listKeys(m.hostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	signers := make([]ssh.Signer, 0, len(hostKeyFiles))
+	for _, keyFile := range hostKeyFiles {
+		key, err := parseHostKeyFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, key)
+	}
+	envKeys, err := getAllEnvHostKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range envKeys {
+		signers = append(signers, key)
+	}
+	return signers, nil
+}
+
+// connTracker records each authenticated user's live connections so
+// kick-user can force them closed without restarting the process.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[string]map[net.Conn]struct{}
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: map[string]map[net.Conn]struct{}{}}
+}
+
+func (t *connTracker) add(userID string, conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns[userID] == nil {
+		t.conns[userID] = map[net.Conn]struct{}{}
+	}
+	t.conns[userID][conn] = struct{}{}
+}
+
+func (t *connTracker) remove(userID string, conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns[userID], conn)
+}
+
+// kick closes every tracked connection for userID and reports how many
+// were closed.
+func (t *connTracker) kick(userID string) int {
+	t.mu.Lock()
+	conns := t.conns[userID]
+	delete(t.conns, userID)
+	t.mu.Unlock()
+	for conn := range conns {
+		conn.Close()
+	}
+	return len(conns)
+}
+
+// trackingConnCallback stashes the raw net.Conn on ctx so later handlers
+// (PublicKeyHandler, in particular) can hand it to a connTracker.
+func trackingConnCallback(ctx ssh.Context, conn net.Conn) net.Conn {
+	ctx.SetValue(contextKeyConn, conn)
+	return conn
+}
+
+// controller wires the Redis control channel to the live server state it
+// is allowed to mutate.
+type controller struct {
+	rdb             *redis.Client
+	server          *ssh.Server
+	hostKeys        *hostKeyManager
+	tracker         *connTracker
+	localWhitelist  *atomicPortList
+	remoteWhitelist *atomicPortList
+	versionStringMu *sync.Mutex
+	// envFilePath is the .env path main() was started with (os.Args[1]),
+	// if any, so reload-whitelist re-reads the same file instead of
+	// always falling back to the default ".env" lookup.
+	envFilePath string
+}
+
+// subscribe starts listening on controlChannel in the background; it
+// returns immediately. It's a no-op when the server was started without
+// Redis, since there's no pub/sub channel to listen on.
+func (c *controller) subscribe() {
+	if c.rdb == nil {
+		logger.Info("no Redis configured: the control channel (reload-hostkeys, reload-whitelist, kick-user, set-version) is disabled")
+		return
+	}
+	sub := c.rdb.Subscribe(context.Background(), controlChannel)
+	go func() {
+		for msg := range sub.Channel() {
+			c.handle(msg.Payload)
+		}
+	}()
+}
+
+func (c *controller) handle(payload string) {
+	switch {
+	case payload == "reload-hostkeys":
+		if err := c.hostKeys.reload(); err != nil {
+			logger.Error("failed to reload host keys", "err", err)
+			return
+		}
+		logger.Info("reloaded host keys")
+
+	case payload == "reload-whitelist":
+		c.reloadWhitelists()
+
+	case strings.HasPrefix(payload, "kick-user:"):
+		userID := strings.TrimPrefix(payload, "kick-user:")
+		n := c.tracker.kick(userID)
+		logger.Info("kicked user", "user", userID, "connections", n)
+
+	case strings.HasPrefix(payload, "set-version:"):
+		version := strings.TrimPrefix(payload, "set-version:")
+		c.versionStringMu.Lock()
+		c.server.Version = version
+		c.versionStringMu.Unlock()
+		logger.Info("updated server version string", "version", version)
+
+	default:
+		logger.Warn("unknown control message", "payload", payload)
+	}
+}
+
+func (c *controller) reloadWhitelists() {
+	var err error
+	if c.envFilePath != "" {
+		err = godotenv.Overload(c.envFilePath)
+	} else {
+		err = godotenv.Overload()
+	}
+	if err != nil {
+		logger.Error("failed to reload env file", "path", c.envFilePath, "err", err)
+		return
+	}
+
+	localPorts, err := extractNumbers(os.Getenv("WHITELIST_PORTS"))
+	if err != nil {
+		logger.Error("failed to reload WHITELIST_PORTS", "err", err)
+		return
+	}
+	remotePorts, err := extractNumbers(os.Getenv("WHITELIST_REMOTE_PORTS"))
+	if err != nil {
+		logger.Error("failed to reload WHITELIST_REMOTE_PORTS", "err", err)
+		return
+	}
+
+	c.localWhitelist.Store(localPorts)
+	c.remoteWhitelist.Store(remotePorts)
+	logger.Info("reloaded port whitelists")
+}
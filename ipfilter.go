@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// parseCIDRList parses a comma-separated list of IPs and/or CIDR blocks,
+// as used by DENY_SOURCE_CIDRS. A bare IP is treated as a /32 (or /128
+// for IPv6).
+func parseCIDRList(input string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, field := range strings.Split(input, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", field)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				field = field + "/32"
+			} else {
+				field = field + "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", field, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// sourceIPDenied reports whether ctx's real client address - as resolved
+// by the PROXY protocol listener when enabled, or the raw TCP peer
+// otherwise - falls inside denylist.
+func sourceIPDenied(denylist []*net.IPNet, ctx ssh.Context) bool {
+	if len(denylist) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(ctx.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range denylist {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
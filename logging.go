@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/gliderlabs/ssh"
+)
+
+var connIDCounter uint64
+
+const contextKeyConnID = "conn-id"
+
+// connLogger returns a logger annotated with a per-connection ID and the
+// authenticated user, assigning the ID the first time it is requested for
+// ctx so every call site for the same connection shares it.
+func connLogger(ctx ssh.Context) *slog.Logger {
+	connID, ok := ctx.Value(contextKeyConnID).(uint64)
+	if !ok {
+		connID = atomic.AddUint64(&connIDCounter, 1)
+		ctx.SetValue(contextKeyConnID, connID)
+	}
+	return logger.With("conn_id", connID, "user", ctx.User(), "client_ip", ctx.RemoteAddr().String())
+}
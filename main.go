@@ -16,6 +16,7 @@ import (
 	"time"
 
 	"github.com/gliderlabs/ssh"
+	"github.com/hiddify/ssh-liberty-bridge/auth"
 	"github.com/joho/godotenv"
 	"github.com/redis/go-redis/v9"
 	gossh "golang.org/x/crypto/ssh"
@@ -53,7 +54,7 @@ func isLocalIP(dhost string) bool{
 	return ip.IsLoopback() || ip.IsLinkLocalMulticast() || ip.IsLinkLocalUnicast() || ip.IsPrivate()
 }
 
-func directTCPIPClosure(rdb *redis.Client) ssh.ChannelHandler {
+func directTCPIPClosure(rdb *redis.Client, quota *quotaManager) ssh.ChannelHandler {
 	return func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
 		d := localForwardChannelData{}
 		if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
@@ -61,10 +62,16 @@ func directTCPIPClosure(rdb *redis.Client) ssh.ChannelHandler {
 			return
 		}
 
+		if err := quota.checkQuota(ctx, ctx.User()); err != nil {
+			newChan.Reject(gossh.Prohibited, err.Error())
+			return
+		}
+
 		ipAddr, err := net.ResolveIPAddr("ip4", d.DestAddr)
 		if err != nil {
 			ipAddr, err = net.ResolveIPAddr("ip6", d.DestAddr)
 			if err != nil {
+				forwardRejectsTotal.WithLabelValues("dns").Inc()
 				newChan.Reject(gossh.Prohibited, "cannot resolve the said address: "+d.DestAddr)
 				return
 			}
@@ -73,10 +80,11 @@ func directTCPIPClosure(rdb *redis.Client) ssh.ChannelHandler {
 		dest := ipAddr.String()
 
 		if srv.LocalPortForwardingCallback == nil || !srv.LocalPortForwardingCallback(ctx, dest, d.DestPort) {
+			forwardRejectsTotal.WithLabelValues("illegal_addr").Inc()
 			newChan.Reject(gossh.Prohibited, "illegal address")
 			return
 		}
-		
+
 		dest = net.JoinHostPort(dest, strconv.FormatInt(int64(d.DestPort), 10))
 
 		var dialer net.Dialer
@@ -85,17 +93,23 @@ func directTCPIPClosure(rdb *redis.Client) ssh.ChannelHandler {
 		if len(SocksProxyAddr) != 0 && !isLocalIP(dest) {
 			pDialer, err := proxy.SOCKS5("tcp", SocksProxyAddr, nil, proxy.Direct)
 			if err != nil {
+				dialFailuresTotal.WithLabelValues("socks").Inc()
+				connLogger(ctx).Error("failed to create socks dialer", "err", err)
 				newChan.Reject(gossh.ConnectionFailed, err.Error())
 				return
 			}
 			dconn, err = pDialer.Dial("tcp", dest)
 			if err != nil {
+				dialFailuresTotal.WithLabelValues("socks").Inc()
+				connLogger(ctx).Error("failed to dial via socks", "dest", dest, "err", err)
 				newChan.Reject(gossh.ConnectionFailed, err.Error())
 				return
 			}
 		} else {
 			dconn, err = dialer.DialContext(ctx, "tcp", dest)
 			if err != nil {
+				dialFailuresTotal.WithLabelValues("direct").Inc()
+				connLogger(ctx).Error("failed to dial destination", "dest", dest, "err", err)
 				newChan.Reject(gossh.ConnectionFailed, err.Error())
 				return
 			}
@@ -108,19 +122,27 @@ func directTCPIPClosure(rdb *redis.Client) ssh.ChannelHandler {
 		}
 		go gossh.DiscardRequests(reqs)
 
+		userID := ctx.User()
+		limiter := quota.limiterFor(userID)
 		go func() {
 			defer ch.Close()
 			defer dconn.Close()
-			result, _ := io.Copy(ch, dconn)
-			userID := ctx.User()
-			rdb.HIncrBy(context.Background(), "ssh-server:users-usage", userID, result)
+			result, _ := io.Copy(shapedWriter{ch, limiter, ctx}, dconn)
+			if rdb != nil {
+				rdb.HIncrBy(context.Background(), "ssh-server:users-usage", userID, result)
+			}
+			quota.recordUsage(userID, result)
+			bytesTotal.WithLabelValues("down", userID).Add(float64(result))
 		}()
 		go func() {
 			defer ch.Close()
 			defer dconn.Close()
-			result, _ := io.Copy(dconn, ch)
-			userID := ctx.User()
-			rdb.HIncrBy(context.Background(), "ssh-server:users-usage", userID, result)
+			result, _ := io.Copy(shapedWriter{dconn, limiter, ctx}, ch)
+			if rdb != nil {
+				rdb.HIncrBy(context.Background(), "ssh-server:users-usage", userID, result)
+			}
+			quota.recordUsage(userID, result)
+			bytesTotal.WithLabelValues("up", userID).Add(float64(result))
 		}()
 	}
 }
@@ -208,9 +230,16 @@ func containsNumber(list []uint32, number uint32) bool {
 }
 
 func main() {
+	if len(os.Args) >= 3 && os.Args[1] == "provision-psk" {
+		provisionPSK(os.Args[2])
+		return
+	}
+
+	var envFilePath string
 	var err error
 	if len(os.Args) == 2 {
-		err = godotenv.Load(os.Args[1])
+		envFilePath = os.Args[1]
+		err = godotenv.Load(envFilePath)
 	} else {
 		err = godotenv.Load()
 	}
@@ -218,11 +247,6 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	redisUrl, ok := os.LookupEnv("REDIS_URL")
-	if !ok {
-		log.Fatalln("REDIS_URL not provided. Consider adding it to .env or the environment variables")
-	}
-
 	listenAddr := os.Getenv("LISTEN_ADDR")
 	if len(listenAddr) == 0 {
 		listenAddr = ":2222"
@@ -230,17 +254,45 @@ func main() {
 
 	SocksProxyAddr = os.Getenv("SOCKS_PROXY")
 	whitelistString := os.Getenv("WHITELIST_PORTS")
-	whitelistPorts, err := extractNumbers(whitelistString)
+	whitelistPortsInitial, err := extractNumbers(whitelistString)
 
 	if err != nil {
 		log.Fatalln("Invalid WHITELIST_PORTS")
 	}
+	whitelistPorts := newAtomicPortList(whitelistPortsInitial)
+
+	whitelistRemotePortsString := os.Getenv("WHITELIST_REMOTE_PORTS")
+	whitelistRemotePortsInitial, err := extractNumbers(whitelistRemotePortsString)
+
+	if err != nil {
+		log.Fatalln("Invalid WHITELIST_REMOTE_PORTS")
+	}
+	whitelistRemotePorts := newAtomicPortList(whitelistRemotePortsInitial)
 
 	hostKeyPath := os.Getenv("HOST_KEY_PATH")
 	if len(hostKeyPath) == 0 {
 		hostKeyPath = "/root/etc/ssh/"
 	}
 
+	preludeEnabled := strings.ToLower(os.Getenv("PRELUDE_ENABLED")) == "true"
+	decoyAddr := os.Getenv("DECOY_ADDR")
+
+	proxyProtocolEnabled := strings.ToLower(os.Getenv("PROXY_PROTOCOL")) == "true"
+
+	denySourceCIDRs, err := parseCIDRList(os.Getenv("DENY_SOURCE_CIDRS"))
+	if err != nil {
+		log.Fatalln("Invalid DENY_SOURCE_CIDRS:", err)
+	}
+
+	userRateBps, err := strconv.ParseFloat(os.Getenv("USER_RATE_BPS"), 64)
+	if err != nil {
+		userRateBps = 0 // unset or invalid: no shaping
+	}
+	userQuotaBytes, err := strconv.ParseInt(os.Getenv("USER_QUOTA_BYTES"), 10, 64)
+	if err != nil {
+		userQuotaBytes = 0 // unset or invalid: no default daily quota
+	}
+
 	maxConnString := os.Getenv("MAX_CONNECTIONS")
 	maxConns, err := strconv.ParseInt(maxConnString, 10, 32)
 	if maxConns == 0 || len(maxConnString) == 0 || err != nil {
@@ -261,70 +313,113 @@ func main() {
 		shouldCopyVersionString = false
 	}
 
-	opts, err := redis.ParseURL(redisUrl)
-	if err != nil {
-		log.Fatalln(err)
+	authBackend := os.Getenv("AUTH_BACKEND")
+	if len(authBackend) == 0 {
+		authBackend = "redis"
 	}
-	rdb := redis.NewClient(opts) // This is safe to use concurrently
-	pingRes := rdb.Ping(context.Background())
-	_, err = pingRes.Result()
-	if err != nil {
-		log.Fatalf("Could not reach the redis server. Aborting: %v", err)
+
+	// Redis is only a hard requirement for the redis auth backend and for
+	// the PSK prelude (which stores its secrets there); AUTH_BACKEND=file
+	// is how a deployment avoids running Redis at all, so everything else
+	// that would normally use rdb (quota accounting, usage recording, the
+	// control channel) degrades to a no-op when it's absent.
+	redisUrl, haveRedisURL := os.LookupEnv("REDIS_URL")
+	redisRequired := authBackend == "redis" || preludeEnabled
+	if redisRequired && !haveRedisURL {
+		log.Fatalln("REDIS_URL not provided. Consider adding it to .env or the environment variables")
 	}
-	rdb.Del(context.Background(), "ssh-server:connections")
-	var userConnectionCountMutex sync.Mutex
+
+	var rdb *redis.Client
+	if haveRedisURL {
+		opts, err := redis.ParseURL(redisUrl)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		rdb = redis.NewClient(opts) // This is safe to use concurrently
+		if _, err := rdb.Ping(context.Background()).Result(); err != nil {
+			log.Fatalf("Could not reach the redis server. Aborting: %v", err)
+		}
+	} else {
+		logger.Info("REDIS_URL not set: running without Redis, quota accounting, usage recording, and the control channel are disabled")
+	}
+
+	var authenticator auth.Authenticator
+	switch authBackend {
+	case "redis":
+		authenticator = auth.NewRedisAuthenticator(rdb, maxConns)
+	case "file":
+		authKeysDir := os.Getenv("AUTH_KEYS_DIR")
+		if len(authKeysDir) == 0 {
+			log.Fatalln("AUTH_KEYS_DIR not provided. Required when AUTH_BACKEND=file")
+		}
+		authenticator = auth.NewFileAuthenticator(authKeysDir, maxConns)
+	default:
+		log.Fatalf("Unknown AUTH_BACKEND %q", authBackend)
+	}
+
+	quota := newQuotaManager(rdb, userRateBps, userQuotaBytes)
+	tracker := newConnTracker()
+
+	var reverseListeners sync.Map
 	server := ssh.Server{
+		ConnCallback: trackingConnCallback,
 		LocalPortForwardingCallback: ssh.LocalPortForwardingCallback(func(ctx ssh.Context, dhost string, dport uint32) bool {
 			//log.Printf("requesting %s", dhost)
+			if sourceIPDenied(denySourceCIDRs, ctx) {
+				forwardRejectsTotal.WithLabelValues("banned_ip").Inc()
+				connLogger(ctx).Warn("rejecting direct-tcpip from denied source IP")
+				return false
+			}
 			if !isLocalIP(dhost){return true}
-			if containsNumber(whitelistPorts, dport) {
+			if containsNumber(whitelistPorts.Load(), dport) {
 				return true
 			}
 			return false
 		}),
-		Addr: listenAddr,
+		ReversePortForwardingCallback: reversePortForwardingCallback(whitelistRemotePorts),
+		Addr:                          listenAddr,
 		ChannelHandlers: map[string]ssh.ChannelHandler{
-			"direct-tcpip": directTCPIPClosure(rdb),
+			"direct-tcpip": directTCPIPClosure(rdb, quota),
+		},
+		RequestHandlers: map[string]ssh.RequestHandler{
+			"tcpip-forward":        tcpipForwardHandler(rdb, quota, &reverseListeners),
+			"cancel-tcpip-forward": cancelTCPIPForwardHandler(rdb, &reverseListeners),
 		},
 		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
-			//log.Printf("User -%s- with key -%s-", ctx.User(), string(gossh.MarshalAuthorizedKey(key)))
-			if len(ctx.User()) != 36 { // it isn't a UUID
+			if !auth.ValidUserID(ctx.User()) {
+				authFailuresTotal.WithLabelValues("bad_uuid").Inc()
 				return false
 			}
 			userId := ctx.User()
-			userString := userId + "::" + string(gossh.MarshalAuthorizedKey(key))
-			userString = strings.Trim(userString, "\n\t\r")
-			result := rdb.SIsMember(ctx, "ssh-server:users", userString)
-			res, err := result.Result()
+			authorizedKeyLine := strings.Trim(string(gossh.MarshalAuthorizedKey(key)), "\n\t\r")
+
+			ok, err := authenticator.Authorize(ctx, userId, authorizedKeyLine)
 			doneCh := ctx.Done()
-			//log.Printf("UserString -%s- res -%s- err -%s-", userString,res,err)
-			if err != nil || !res || doneCh == nil {
-				//log.Printf("returning false 1")
+			if err != nil || !ok || doneCh == nil {
+				authFailuresTotal.WithLabelValues("unknown_user").Inc()
 				return false
 			}
-			userConnectionCountMutex.Lock()
-			defer userConnectionCountMutex.Unlock()
-			hget_res := rdb.HGet(ctx, "ssh-server:connections", userId)
-			// It doesn't matter if we get an error (the key does not exist),
-			// if there is something more serious it will be handled in HIncrBy
-			connCntStr, _ := hget_res.Result()
-			connCnt, err2 := strconv.ParseInt(connCntStr, 10, 32)
-			if err2 == nil && connCnt >= maxConns {
-				//log.Printf("returning false 2")
-				//log.Printf("Client %s trying to have more than %d connections\n", userString, maxConns)
+
+			if err := authenticator.Acquire(ctx, userId); err != nil {
+				authFailuresTotal.WithLabelValues("quota").Inc()
+				connLogger(ctx).Warn("rejecting connection over quota", "max_connections", maxConns)
 				return false // No duplicate connections
 			}
-			hincr_res := rdb.HIncrBy(ctx, "ssh-server:connections", userId, 1)
-			if hincr_res.Err() != nil {
-				//log.Printf("returning false 3 %s",hincr_res.Err())
-				return false
+
+			if conn, ok := ctx.Value(contextKeyConn).(net.Conn); ok {
+				tracker.add(userId, conn)
 			}
+			activeConnections.WithLabelValues(userId).Inc()
+			connectedAt := time.Now()
 			go func() {
 				<-doneCh
-				//log.Printf("4---",userId)
-				rdb.HIncrBy(context.Background(), "ssh-server:connections", userId, -1)
+				authenticator.Release(userId)
+				if conn, ok := ctx.Value(contextKeyConn).(net.Conn); ok {
+					tracker.remove(userId, conn)
+				}
+				activeConnections.WithLabelValues(userId).Dec()
+				sessionDurationSeconds.Observe(time.Since(connectedAt).Seconds())
 			}()
-			//log.Printf("returning true ")
 			return true
 		},
 		IdleTimeout: time.Minute * 1,
@@ -335,7 +430,7 @@ func main() {
 	var versionStringMutex sync.Mutex // Not really used now, but can be helpful in the future
 	go func() {
 		if !shouldCopyVersionString {
-			log.Println("Not copying the version string from another server")
+			logger.Info("not copying the version string from another server")
 			return
 		}
 		buf := make([]byte, 256)
@@ -344,13 +439,13 @@ func main() {
 			delayAmount += time.Millisecond * time.Duration(rand.Float32()*3600*1000)
 			conn, err := net.Dial("tcp", copyVersionString)
 			if err != nil {
-				log.Printf("Could not copy the version string from another server: %v\n", err)
+				logger.Warn("could not copy the version string from another server", "err", err)
 				time.Sleep(delayAmount)
 				continue
 			}
 			n, err := conn.Read(buf)
 			if err != nil || n == len(buf) {
-				log.Printf("Invalid response from the to-be-copied ssh server, len=%d: %v\n", n, err)
+				logger.Warn("invalid response from the to-be-copied ssh server", "len", n, "err", err)
 				time.Sleep(delayAmount)
 				conn.Close()
 				continue
@@ -367,7 +462,7 @@ func main() {
 			result := string(resBuf)
 			result = strings.Trim(result, "\n\t\r")
 			if !strings.HasPrefix(result, "SSH-2.0-") {
-				log.Printf("The result from to-be-copied ssh server is invalid, does not start with `SSH-2.0-`")
+				logger.Warn("the result from to-be-copied ssh server is invalid, does not start with `SSH-2.0-`")
 				time.Sleep(delayAmount)
 				continue
 			}
@@ -379,28 +474,50 @@ func main() {
 		}
 	}()
 
-	hostKeyFiles, err := listKeys(hostKeyPath)
-	if err != nil {
-		log.Fatalf("Could not get the host keys: %v\n", err)
+	hostKeys := newHostKeyManager(&server, hostKeyPath)
+	if err := hostKeys.install(); err != nil {
+		log.Fatalf("Could not load the host keys: %v\n", err)
 	}
-	for _, keyFile := range hostKeyFiles {
-		hostKey, err := parseHostKeyFile(keyFile)
-		if err != nil {
-			log.Fatalf("Failed to parse host key file %s: %v", keyFile, err)
-		}
 
-		server.AddHostKey(hostKey)
-	}
-	envkeys, err := getAllEnvHostKeys()
-	if err != nil {
-		log.Fatalf("Failed to parse end keys  %v", err)
+	control := &controller{
+		rdb:             rdb,
+		server:          &server,
+		hostKeys:        hostKeys,
+		tracker:         tracker,
+		localWhitelist:  whitelistPorts,
+		remoteWhitelist: whitelistRemotePorts,
+		versionStringMu: &versionStringMutex,
+		envFilePath:     envFilePath,
 	}
-	for _, hostKey := range envkeys {
-		server.AddHostKey(hostKey)
+	control.subscribe()
+	if rdb != nil {
+		logger.Info("listening for control messages", "channel", controlChannel)
 	}
 
 	time.Sleep(time.Second * 1) // Wait for the version string to settle in
 
-	log.Printf("starting ssh-liberty-bridge on %s...\n", listenAddr)
+	metricsAddr := os.Getenv("METRICS_ADDR")
+	if len(metricsAddr) != 0 {
+		go serveMetrics(metricsAddr)
+		logger.Info("serving prometheus metrics", "addr", metricsAddr)
+	}
+
+	logger.Info("starting ssh-liberty-bridge", "addr", listenAddr)
+	if preludeEnabled || proxyProtocolEnabled {
+		ln, err := net.Listen("tcp", listenAddr)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		var wrapped net.Listener = ln
+		if proxyProtocolEnabled {
+			logger.Info("PROXY protocol enabled")
+			wrapped = newProxyProtoListener(wrapped)
+		}
+		if preludeEnabled {
+			logger.Info("prelude PSK handshake enabled", "decoy_addr", decoyAddr)
+			wrapped = newPreludeListener(wrapped, rdb, decoyAddr)
+		}
+		log.Fatal(server.Serve(wrapped))
+	}
 	log.Fatal(server.ListenAndServe())
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	activeConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ssh_active_connections",
+		Help: "Number of currently open SSH connections.",
+	}, []string{"user"})
+
+	bytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ssh_bytes_total",
+		Help: "Bytes forwarded through the bridge.",
+	}, []string{"direction", "user"})
+
+	authFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ssh_auth_failures_total",
+		Help: "SSH authentication failures by reason.",
+	}, []string{"reason"})
+
+	dialFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ssh_dial_failures_total",
+		Help: "Failures dialing the forwarding destination.",
+	}, []string{"via"})
+
+	forwardRejectsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ssh_forward_rejects_total",
+		Help: "Channels rejected before a connection was attempted.",
+	}, []string{"reason"})
+
+	sessionDurationSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ssh_session_duration_seconds",
+		Help:    "Duration of SSH connections from authentication to close.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// serveMetrics starts the Prometheus /metrics endpoint on addr. It blocks,
+// so it should be run in its own goroutine; it is only started when
+// METRICS_ADDR is set.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	logger.Error("metrics server stopped", "err", http.ListenAndServe(addr, mux))
+}
+
+// logger is the process-wide structured logger; log.Printf call sites are
+// being migrated to it incrementally.
+var logger = slog.Default()
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/redis/go-redis/v9"
+)
+
+// preludeSecretLen is the size of a freshly provisioned PSK; it must be
+// at least preludeSecretPrefixLen.
+const preludeSecretLen = 32
+
+// provisionPSK implements `ssh-liberty-bridge provision-psk <user-uuid>`:
+// it generates a fresh pre-shared key, stores it in Redis under
+// ssh-server:users-psk and prints it so the operator can hand it to the
+// user's client configuration.
+func provisionPSK(userID string) {
+	_ = godotenv.Load()
+	redisUrl, ok := os.LookupEnv("REDIS_URL")
+	if !ok {
+		log.Fatalln("REDIS_URL not provided. Consider adding it to .env or the environment variables")
+	}
+	opts, err := redis.ParseURL(redisUrl)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	rdb := redis.NewClient(opts)
+
+	secret := make([]byte, preludeSecretLen)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatalln(err)
+	}
+
+	hexSecret := hex.EncodeToString(secret)
+	if err := rdb.HSet(context.Background(), "ssh-server:users-psk", userID, hexSecret).Err(); err != nil {
+		log.Fatalln(err)
+	}
+
+	log.Printf("provisioned PSK for %s: %s\n", userID, hexSecret)
+}
+
+// preludeMacLen is len(HMAC-SHA256(secret, timestamp||nonce)).
+const preludeMacLen = sha256.Size
+
+// preludeNonceLen is the size of the random nonce that accompanies the
+// timestamp in the prelude handshake, used for replay protection.
+const preludeNonceLen = 16
+
+// preludeSecretPrefixLen is how many bytes of a user's shared secret are
+// sent up front so the listener knows which Redis-stored secret to check
+// the HMAC against, without the client revealing its user UUID.
+const preludeSecretPrefixLen = 16
+
+// preludeWindow bounds how far the client's timestamp may drift from the
+// server's clock before the handshake is rejected.
+const preludeWindow = 60 * time.Second
+
+// preludeHandshakeTimeout bounds how long a connection may take to present
+// its prelude before it's abandoned, so a client that sends nothing (or
+// only a partial prelude) can't stall out a connection slot forever.
+const preludeHandshakeTimeout = 10 * time.Second
+
+// preludeLen is the total size of the prelude read off the wire: a prefix
+// of the shared secret, a timestamp, a replay nonce, and the HMAC over the
+// latter two.
+const preludeLen = preludeSecretPrefixLen + 8 + preludeNonceLen + preludeMacLen
+
+// preludeListener wraps a net.Listener so that, before a connection is
+// handed to the gliderlabs/ssh server, the client must prove it holds a
+// per-user pre-shared key. Connections that fail the check are
+// transparently proxied to decoyAddr (if set) so a scanner sees an
+// ordinary SSH server instead of a connection reset.
+type preludeListener struct {
+	net.Listener
+	rdb       *redis.Client
+	decoyAddr string
+	results   chan preludeAcceptResult
+	once      sync.Once
+}
+
+// preludeAcceptResult carries a fully-admitted connection (or a fatal
+// listener error) back to Accept from the background accept loop.
+type preludeAcceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// newPreludeListener wraps inner with the PSK prelude described above.
+func newPreludeListener(inner net.Listener, rdb *redis.Client, decoyAddr string) *preludeListener {
+	return &preludeListener{Listener: inner, rdb: rdb, decoyAddr: decoyAddr, results: make(chan preludeAcceptResult)}
+}
+
+func (l *preludeListener) Accept() (net.Conn, error) {
+	l.once.Do(func() { go l.acceptLoop() })
+	res := <-l.results
+	return res.conn, res.err
+}
+
+// acceptLoop runs in the background for the lifetime of the listener,
+// accepting raw connections and handing each to its own goroutine for
+// prelude handling so a slow or silent client can't block the connections
+// behind it in the queue.
+func (l *preludeListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.results <- preludeAcceptResult{err: err}
+			return
+		}
+		go l.admitAsync(conn)
+	}
+}
+
+// admitAsync bounds conn's prelude handshake with a deadline, runs it, and
+// - if admitted - clears the deadline and publishes conn to Accept.
+func (l *preludeListener) admitAsync(conn net.Conn) {
+	if err := conn.SetDeadline(time.Now().Add(preludeHandshakeTimeout)); err != nil {
+		conn.Close()
+		return
+	}
+	if !l.admit(conn) {
+		return
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return
+	}
+	l.results <- preludeAcceptResult{conn: conn}
+}
+
+// admit reads the prelude from conn and reports whether it should be
+// handed to the SSH server. If the prelude doesn't check out, admit
+// itself disposes of conn (by proxying it to the decoy or closing it) and
+// returns false.
+func (l *preludeListener) admit(conn net.Conn) bool {
+	buf := make([]byte, preludeLen)
+	n, err := io.ReadFull(conn, buf)
+	if err != nil {
+		l.reject(conn, buf[:n])
+		return false
+	}
+
+	secretPrefix := buf[:preludeSecretPrefixLen]
+	tsBuf := buf[preludeSecretPrefixLen : preludeSecretPrefixLen+8]
+	nonce := buf[preludeSecretPrefixLen+8 : preludeSecretPrefixLen+8+preludeNonceLen]
+	mac := buf[preludeSecretPrefixLen+8+preludeNonceLen:]
+
+	ts := int64(binary.BigEndian.Uint64(tsBuf))
+	skew := time.Since(time.Unix(ts, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > preludeWindow {
+		l.reject(conn, buf)
+		return false
+	}
+
+	secret, ok := l.lookupSecret(secretPrefix)
+	if !ok {
+		l.reject(conn, buf)
+		return false
+	}
+
+	h := hmac.New(sha256.New, secret)
+	h.Write(tsBuf)
+	h.Write(nonce)
+	if !hmac.Equal(h.Sum(nil), mac) {
+		l.reject(conn, buf)
+		return false
+	}
+
+	if !l.claimNonce(nonce) {
+		l.reject(conn, buf)
+		return false
+	}
+
+	return true
+}
+
+// lookupSecret scans ssh-server:users-psk for a secret whose first
+// preludeSecretPrefixLen bytes match prefix.
+func (l *preludeListener) lookupSecret(prefix []byte) ([]byte, bool) {
+	secrets, err := l.rdb.HGetAll(context.Background(), "ssh-server:users-psk").Result()
+	if err != nil {
+		return nil, false
+	}
+	for _, hexSecret := range secrets {
+		secret, err := hex.DecodeString(hexSecret)
+		if err != nil || len(secret) < preludeSecretPrefixLen {
+			continue
+		}
+		if hmac.Equal(secret[:preludeSecretPrefixLen], prefix) {
+			return secret, true
+		}
+	}
+	return nil, false
+}
+
+// claimNonce reports whether nonce has not been seen before, recording it
+// in Redis for twice the allowed clock skew window so a captured prelude
+// can't be replayed.
+func (l *preludeListener) claimNonce(nonce []byte) bool {
+	key := "ssh-server:prelude-nonces:" + hex.EncodeToString(nonce)
+	ok, err := l.rdb.SetNX(context.Background(), key, 1, 2*preludeWindow).Result()
+	return err == nil && ok
+}
+
+// reject either proxies the connection to the configured decoy address
+// (replaying whatever prelude bytes were already consumed) or closes it.
+func (l *preludeListener) reject(conn net.Conn, consumed []byte) {
+	defer conn.Close()
+	if len(l.decoyAddr) == 0 {
+		return
+	}
+	decoyConn, err := net.Dial("tcp", l.decoyAddr)
+	if err != nil {
+		return
+	}
+	defer decoyConn.Close()
+	// The handshake deadline set by admitAsync only bounds the prelude;
+	// the decoy session itself runs without it.
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return
+	}
+	if len(consumed) != 0 {
+		if _, err := decoyConn.Write(consumed); err != nil {
+			return
+		}
+	}
+	go io.Copy(decoyConn, conn)
+	io.Copy(conn, decoyConn)
+}
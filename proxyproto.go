@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtoHandshakeTimeout bounds how long a connection may take to
+// present its PROXY protocol header before it's abandoned, so a client
+// that sends nothing (or only a partial header) can't stall out a
+// connection slot forever.
+const proxyProtoHandshakeTimeout = 10 * time.Second
+
+// proxyProtoListener wraps a net.Listener to parse a PROXY protocol v1/v2
+// header (as sent by HAProxy, nginx stream, or Cloudflare Spectrum) off
+// the front of each accepted connection, so RemoteAddr reports the real
+// client IP instead of the load balancer's.
+type proxyProtoListener struct {
+	net.Listener
+	results chan proxyProtoAcceptResult
+	once    sync.Once
+}
+
+// proxyProtoAcceptResult carries a fully-handshaken connection (or a fatal
+// listener error) back to Accept from the background accept loop.
+type proxyProtoAcceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newProxyProtoListener(inner net.Listener) *proxyProtoListener {
+	return &proxyProtoListener{Listener: inner, results: make(chan proxyProtoAcceptResult)}
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	l.once.Do(func() { go l.acceptLoop() })
+	res := <-l.results
+	return res.conn, res.err
+}
+
+// acceptLoop runs in the background for the lifetime of the listener,
+// accepting raw connections and handing each to its own goroutine to parse
+// its header, so a slow or silent client can't block the connections
+// behind it in the queue.
+func (l *proxyProtoListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.results <- proxyProtoAcceptResult{err: err}
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+// handshake bounds conn's PROXY protocol header parse with a deadline,
+// runs it, and - on success - clears the deadline and publishes the
+// wrapped connection to Accept.
+func (l *proxyProtoListener) handshake(conn net.Conn) {
+	if err := conn.SetDeadline(time.Now().Add(proxyProtoHandshakeTimeout)); err != nil {
+		conn.Close()
+		return
+	}
+	pc, err := newProxyProtoConn(conn)
+	if err != nil {
+		return
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return
+	}
+	l.results <- proxyProtoAcceptResult{conn: pc}
+}
+
+// proxyProtoConn is a net.Conn whose RemoteAddr has been overridden with
+// the client address parsed from a PROXY protocol header, while any bytes
+// read past the header are replayed to callers via a buffered reader.
+type proxyProtoConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func newProxyProtoConn(conn net.Conn) (*proxyProtoConn, error) {
+	r := bufio.NewReader(conn)
+	remoteAddr, err := parseProxyProtoHeader(r)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy protocol: %w", err)
+	}
+	if remoteAddr == nil {
+		remoteAddr = conn.RemoteAddr()
+	}
+	return &proxyProtoConn{Conn: conn, r: r, remoteAddr: remoteAddr}, nil
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+var proxyProtoV2Sig = [12]byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// parseProxyProtoHeader consumes a v1 or v2 PROXY protocol header from r
+// and returns the real client address it describes. A nil address with a
+// nil error means the header carried no client address (a v2 LOCAL
+// command or a v1 UNKNOWN line) and the connection's own address should
+// be used. A connection that doesn't start with a PROXY header at all is
+// an error.
+func parseProxyProtoHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyProtoV2Sig))
+	if err == nil && string(sig) == string(proxyProtoV2Sig[:]) {
+		return parseProxyProtoV2(r)
+	}
+
+	line, err := r.Peek(5)
+	if err == nil && string(line) == "PROXY" {
+		return parseProxyProtoV1(r)
+	}
+
+	return nil, errors.New("missing PROXY protocol header")
+}
+
+func parseProxyProtoV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	fields := strings.Split(line, " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("malformed v1 header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, errors.New("malformed v1 header")
+	}
+	port, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("malformed v1 source port: %w", err)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, errors.New("malformed v1 source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func parseProxyProtoV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := readFull(r, header); err != nil {
+		return nil, err
+	}
+
+	verCmd := header[12]
+	if verCmd>>4 != 2 {
+		return nil, errors.New("unsupported v2 version")
+	}
+	cmd := verCmd & 0x0F
+	family := header[13] >> 4
+	protocol := header[13] & 0x0F
+	length := int(header[14])<<8 | int(header[15])
+
+	body := make([]byte, length)
+	if _, err := readFull(r, body); err != nil {
+		return nil, err
+	}
+
+	if cmd == 0x0 { // LOCAL: health check from the proxy itself, keep its own address
+		return nil, nil
+	}
+	if protocol != 0x1 { // only TCP is meaningful for an SSH listener
+		return nil, errors.New("unsupported v2 protocol")
+	}
+
+	switch family {
+	case 0x1: // AF_INET
+		if length < 12 {
+			return nil, errors.New("short v2 IPv4 body")
+		}
+		ip := net.IP(body[0:4])
+		port := int(body[8])<<8 | int(body[9])
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	case 0x2: // AF_INET6
+		if length < 36 {
+			return nil, errors.New("short v2 IPv6 body")
+		}
+		ip := net.IP(body[0:16])
+		port := int(body[32])<<8 | int(body[33])
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	default:
+		return nil, errors.New("unsupported v2 address family")
+	}
+}
+
+func readFull(r *bufio.Reader, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
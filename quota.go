@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterBurst bounds how many bytes a single io.Copy buffer may push
+// through a quotaManager limiter without waiting; it must be at least as
+// large as the largest single Write the copiers issue.
+const rateLimiterBurst = 32 * 1024
+
+// quotaManager enforces per-user daily byte quotas and sustained-rate
+// shaping on top of the existing users-usage Redis accounting.
+type quotaManager struct {
+	rdb          *redis.Client
+	rateBps      float64
+	defaultQuota int64
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// newQuotaManager returns a quotaManager shaping each user to rateBps
+// sustained bytes/sec (<= 0 disables shaping) and enforcing defaultQuota
+// daily bytes (<= 0 disables the default, per-user overrides still apply)
+// for any user without an override in ssh-server:users-quota.
+func newQuotaManager(rdb *redis.Client, rateBps float64, defaultQuota int64) *quotaManager {
+	return &quotaManager{rdb: rdb, rateBps: rateBps, defaultQuota: defaultQuota, limiters: map[string]*rate.Limiter{}}
+}
+
+// usageWindowKey returns the sliding-window usage hash key for the
+// current day.
+func usageWindowKey() string {
+	return "ssh-server:users-usage-window:" + time.Now().Format("20060102")
+}
+
+// checkQuota returns an error describing why userID is over its daily
+// quota (stored per-user in ssh-server:users-quota), or nil if the user
+// may open another channel. Quota enforcement is Redis-backed, so this is
+// always nil when the server is running without Redis.
+func (q *quotaManager) checkQuota(ctx context.Context, userID string) error {
+	if q.rdb == nil {
+		return nil
+	}
+	quota := q.defaultQuota
+	quotaStr, err := q.rdb.HGet(ctx, "ssh-server:users-quota", userID).Result()
+	if err == nil && quotaStr != "" {
+		if parsed, err := strconv.ParseInt(quotaStr, 10, 64); err == nil {
+			quota = parsed
+		}
+	}
+	if quota <= 0 {
+		return nil // no quota configured for this user
+	}
+
+	usageStr, _ := q.rdb.HGet(ctx, usageWindowKey(), userID).Result()
+	usage, _ := strconv.ParseInt(usageStr, 10, 64)
+	if usage >= quota {
+		return fmt.Errorf("daily quota of %d bytes exceeded", quota)
+	}
+	return nil
+}
+
+// recordUsage mirrors n bytes into today's sliding-window hash, alongside
+// the caller's existing cumulative ssh-server:users-usage HIncrBy.
+func (q *quotaManager) recordUsage(userID string, n int64) {
+	if n == 0 || q.rdb == nil {
+		return
+	}
+	key := usageWindowKey()
+	q.rdb.HIncrBy(context.Background(), key, userID, n)
+	q.rdb.Expire(context.Background(), key, 48*time.Hour)
+}
+
+// limiterFor returns the token-bucket limiter shared by all of userID's
+// concurrent channels, creating one lazily. Returns nil when shaping is
+// disabled.
+func (q *quotaManager) limiterFor(userID string) *rate.Limiter {
+	if q.rateBps <= 0 {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	l, ok := q.limiters[userID]
+	if !ok {
+		burst := rateLimiterBurst
+		if int(q.rateBps) > burst {
+			burst = int(q.rateBps)
+		}
+		l = rate.NewLimiter(rate.Limit(q.rateBps), burst)
+		q.limiters[userID] = l
+	}
+	return l
+}
+
+// shapedWriter wraps w so that, when limiter is non-nil, writes are
+// throttled to its token bucket. A nil limiter makes it a passthrough.
+// ctx should be the connection's (or channel's) context, so a shaped copy
+// blocked waiting on the limiter is released as soon as the peer goes
+// away instead of waiting out its full token-bucket delay.
+type shapedWriter struct {
+	io.Writer
+	limiter *rate.Limiter
+	ctx     context.Context
+}
+
+func (w shapedWriter) Write(p []byte) (int, error) {
+	if w.limiter == nil {
+		return w.Writer.Write(p)
+	}
+	if err := w.limiter.WaitN(w.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return w.Writer.Write(p)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/redis/go-redis/v9"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// remoteForwardRequest is the payload of a "tcpip-forward" global request,
+// i.e. the server side of `ssh -R bindAddr:bindPort:...`.
+type remoteForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+type remoteForwardSuccess struct {
+	BindPort uint32
+}
+
+type remoteForwardCancelRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// forwardedTCPIPChannelData is the payload attached to a "forwarded-tcpip"
+// channel opened back to the client once a connection arrives on a
+// tcpip-forward listener.
+type forwardedTCPIPChannelData struct {
+	DestAddr string
+	DestPort uint32
+
+	OriginAddr string
+	OriginPort uint32
+}
+
+// userListeners tracks the listeners a single connection opened via
+// tcpip-forward, keyed by "host:port", so cancel-tcpip-forward and
+// connection teardown can close them again.
+type userListeners struct {
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+}
+
+// usersListenersKey returns the Redis set holding every "host:port" a
+// user currently has bound via tcpip-forward. It's a per-user set rather
+// than a single hash field so concurrent `-R` tunnels from the same user
+// don't clobber each other's entry.
+func usersListenersKey(userID string) string {
+	return "ssh-server:users-listeners:" + userID
+}
+
+// reversePortForwardingCallback enforces WHITELIST_REMOTE_PORTS, with 0 in
+// the list meaning "any port is allowed, assign ephemeral or not".
+func reversePortForwardingCallback(whitelistRemotePorts *atomicPortList) ssh.ReversePortForwardingCallback {
+	return func(ctx ssh.Context, bindHost string, bindPort uint32) bool {
+		ports := whitelistRemotePorts.Load()
+		if containsNumber(ports, 0) {
+			return true
+		}
+		return containsNumber(ports, bindPort)
+	}
+}
+
+// tcpipForwardHandler implements the "tcpip-forward" global request: it
+// opens a listener on behalf of the client and funnels accepted
+// connections back through "forwarded-tcpip" channels, accounting bytes
+// through the same users-usage hash as directTCPIPClosure.
+func tcpipForwardHandler(rdb *redis.Client, quota *quotaManager, listeners *sync.Map) ssh.RequestHandler {
+	return func(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+		var reqPayload remoteForwardRequest
+		if err := gossh.Unmarshal(req.Payload, &reqPayload); err != nil {
+			return false, nil
+		}
+
+		if err := quota.checkQuota(ctx, ctx.User()); err != nil {
+			return false, nil
+		}
+
+		if srv.ReversePortForwardingCallback == nil || !srv.ReversePortForwardingCallback(ctx, reqPayload.BindAddr, reqPayload.BindPort) {
+			forwardRejectsTotal.WithLabelValues("illegal_addr").Inc()
+			return false, nil
+		}
+
+		addr := net.JoinHostPort(reqPayload.BindAddr, strconv.FormatUint(uint64(reqPayload.BindPort), 10))
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			dialFailuresTotal.WithLabelValues("direct").Inc()
+			return false, nil
+		}
+
+		_, portStr, err := net.SplitHostPort(ln.Addr().String())
+		if err != nil {
+			ln.Close()
+			return false, nil
+		}
+		port, err := strconv.ParseUint(portStr, 10, 32)
+		if err != nil {
+			ln.Close()
+			return false, nil
+		}
+
+		userID := ctx.User()
+		boundAddr := net.JoinHostPort(reqPayload.BindAddr, portStr)
+		ulVal, _ := listeners.LoadOrStore(ctx, &userListeners{listeners: map[string]net.Listener{}})
+		ul := ulVal.(*userListeners)
+		ul.mu.Lock()
+		ul.listeners[boundAddr] = ln
+		ul.mu.Unlock()
+
+		if rdb != nil {
+			rdb.SAdd(context.Background(), usersListenersKey(userID), boundAddr)
+		}
+
+		go func() {
+			<-ctx.Done()
+			ul.mu.Lock()
+			l, ok := ul.listeners[boundAddr]
+			delete(ul.listeners, boundAddr)
+			empty := len(ul.listeners) == 0
+			ul.mu.Unlock()
+			if ok {
+				l.Close()
+			}
+			if empty {
+				listeners.Delete(ctx)
+			}
+			if rdb != nil {
+				rdb.SRem(context.Background(), usersListenersKey(userID), boundAddr)
+			}
+		}()
+
+		go acceptForwardedConns(rdb, quota, ctx, ln, reqPayload.BindAddr, uint32(port))
+
+		return true, gossh.Marshal(&remoteForwardSuccess{BindPort: uint32(port)})
+	}
+}
+
+// cancelTCPIPForwardHandler implements the "cancel-tcpip-forward" global
+// request, closing the matching listener opened by tcpipForwardHandler and
+// removing it from the users-listeners set. Per RFC 4254, the client is
+// responsible for sending back the actual bound port here (not 0) when
+// the original request asked for an ephemeral one.
+func cancelTCPIPForwardHandler(rdb *redis.Client, listeners *sync.Map) ssh.RequestHandler {
+	return func(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+		var reqPayload remoteForwardCancelRequest
+		if err := gossh.Unmarshal(req.Payload, &reqPayload); err != nil {
+			return false, nil
+		}
+
+		boundAddr := net.JoinHostPort(reqPayload.BindAddr, strconv.FormatUint(uint64(reqPayload.BindPort), 10))
+		ulVal, ok := listeners.Load(ctx)
+		if !ok {
+			return false, nil
+		}
+		ul := ulVal.(*userListeners)
+		ul.mu.Lock()
+		ln, ok := ul.listeners[boundAddr]
+		delete(ul.listeners, boundAddr)
+		ul.mu.Unlock()
+		if !ok {
+			return false, nil
+		}
+		ln.Close()
+		if rdb != nil {
+			rdb.SRem(context.Background(), usersListenersKey(ctx.User()), boundAddr)
+		}
+		return true, nil
+	}
+}
+
+func acceptForwardedConns(rdb *redis.Client, quota *quotaManager, ctx ssh.Context, ln net.Listener, bindAddr string, bindPort uint32) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		if err := quota.checkQuota(ctx, ctx.User()); err != nil {
+			c.Close()
+			continue
+		}
+		go forwardAcceptedConn(rdb, quota, ctx, bindAddr, bindPort, c)
+	}
+}
+
+func forwardAcceptedConn(rdb *redis.Client, quota *quotaManager, ctx ssh.Context, bindAddr string, bindPort uint32, c net.Conn) {
+	defer c.Close()
+
+	sshConn, ok := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+	if !ok {
+		return
+	}
+
+	originAddr, originPortStr, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+	originPort, _ := strconv.ParseUint(originPortStr, 10, 32)
+
+	payload := gossh.Marshal(&forwardedTCPIPChannelData{
+		DestAddr:   bindAddr,
+		DestPort:   bindPort,
+		OriginAddr: originAddr,
+		OriginPort: uint32(originPort),
+	})
+
+	ch, reqs, err := sshConn.OpenChannel("forwarded-tcpip", payload)
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	go gossh.DiscardRequests(reqs)
+
+	userID := ctx.User()
+	limiter := quota.limiterFor(userID)
+	go func() {
+		result, _ := io.Copy(shapedWriter{ch, limiter, ctx}, c)
+		if rdb != nil {
+			rdb.HIncrBy(context.Background(), "ssh-server:users-usage", userID, result)
+		}
+		quota.recordUsage(userID, result)
+	}()
+	result, _ := io.Copy(shapedWriter{c, limiter, ctx}, ch)
+	if rdb != nil {
+		rdb.HIncrBy(context.Background(), "ssh-server:users-usage", userID, result)
+	}
+	quota.recordUsage(userID, result)
+}
@@ -0,0 +1,24 @@
+package main
+
+import "sync/atomic"
+
+// atomicPortList is a hot-swappable WHITELIST_PORTS/WHITELIST_REMOTE_PORTS
+// snapshot, so reload-whitelist can replace it without restarting the
+// server or racing with in-flight forwarding callbacks.
+type atomicPortList struct {
+	v atomic.Value
+}
+
+func newAtomicPortList(initial []uint32) *atomicPortList {
+	a := &atomicPortList{}
+	a.v.Store(initial)
+	return a
+}
+
+func (a *atomicPortList) Load() []uint32 {
+	return a.v.Load().([]uint32)
+}
+
+func (a *atomicPortList) Store(ports []uint32) {
+	a.v.Store(ports)
+}